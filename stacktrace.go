@@ -6,12 +6,22 @@
 package raven
 
 import (
+	"archive/zip"
 	"bytes"
+	"container/list"
+	"errors"
+	"hash/fnv"
+	"io/fs"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 // http://sentry.readthedocs.org/en/latest/developer/interfaces/index.html#sentry.interfaces.Stacktrace
@@ -36,6 +46,13 @@ type StacktraceFrame struct {
 	PreContext   []string `json:"pre_context,omitempty"`
 	PostContext  []string `json:"post_context,omitempty"`
 	InApp        *bool    `json:"in_app,omitempty"`
+
+	// Package is the module path and version (e.g. "github.com/pkg/errors@v0.9.1")
+	// that this frame's file was resolved from, for module-aware builds. It is
+	// set only for files in the module cache of a versioned, unreplaced
+	// dependency; frames from the main module or the standard library leave
+	// it empty.
+	Package string `json:"package,omitempty"`
 }
 
 // Intialize and populate a new stacktrace, skipping skip frames.
@@ -47,14 +64,120 @@ type StacktraceFrame struct {
 // appPackagePrefixes is a list of prefixes used to check whether a package should
 // be considered "in app".
 func NewStacktrace(skip int, context int, appPackagePrefixes []string) *Stacktrace {
+	// 3 skips runtime.Callers itself, the callers() helper, and this
+	// function, matching the runtime.Caller(1+skip) convention the old
+	// loop relied on.
+	pcs := callers(3 + skip)
+	if len(pcs) == 0 {
+		return &Stacktrace{}
+	}
+	return &Stacktrace{framesFromPCs(pcs, context, appPackagePrefixes)}
+}
+
+// callers is runtime.Callers with the buffer grown and retried until it's
+// big enough to hold the whole stack, the same pattern runtime/debug.Stack
+// uses, so deep stacks aren't silently truncated.
+func callers(skip int) []uintptr {
+	pcs := make([]uintptr, 64)
+	for {
+		n := runtime.Callers(skip, pcs)
+		if n < len(pcs) {
+			return pcs[:n]
+		}
+		pcs = make([]uintptr, len(pcs)*2)
+	}
+}
+
+// GetOrNewStacktrace tries to recover an origin-accurate stacktrace from err
+// before falling back to capturing one at the current call site.
+//
+// It recognizes stack traces attached by github.com/pkg/errors (anything
+// exposing a StackTrace() []uintptr-like method, inspected via reflection so
+// this package doesn't need to depend on pkg/errors directly) and, following
+// Go 1.13 error wrapping conventions, walks the err.Unwrap() chain to find
+// the deepest error carrying one. This keeps the original call site intact
+// when err has been wrapped with fmt.Errorf("...: %w", err) on its way up.
+//
+// If no embedded trace is found, it behaves like NewStacktrace(skip+1,
+// context, appPackagePrefixes); the +1 accounts for this function's own
+// frame.
+//
+// NOTE: this package does not currently contain a Client/CaptureError, so
+// there is nothing here to wire GetOrNewStacktrace through automatically.
+// Callers that have their own Client.CaptureError should call
+// GetOrNewStacktrace(err, 1, ...) instead of NewStacktrace(skip, ...) to get
+// origin-accurate traces for wrapped errors.
+func GetOrNewStacktrace(err error, skip int, context int, appPackagePrefixes []string) *Stacktrace {
+	if err != nil {
+		var deepest *Stacktrace
+		for e := err; e != nil; e = errors.Unwrap(e) {
+			if st := stacktraceFromError(e, context, appPackagePrefixes); st != nil {
+				deepest = st
+			}
+		}
+		if deepest != nil {
+			return deepest
+		}
+	}
+	return NewStacktrace(skip+1, context, appPackagePrefixes)
+}
+
+// stacktraceFromError extracts a Stacktrace from err if it implements the
+// `StackTrace() errors.StackTrace` interface popularized by
+// github.com/pkg/errors, where errors.StackTrace is a []errors.Frame of
+// uintptr program counters. We use reflection rather than importing
+// pkg/errors so this package doesn't take on the dependency.
+func stacktraceFromError(err error, context int, appPackagePrefixes []string) *Stacktrace {
+	method := reflect.ValueOf(err).MethodByName("StackTrace")
+	if !method.IsValid() || method.Type().NumIn() != 0 || method.Type().NumOut() != 1 {
+		return nil
+	}
+	rframes := method.Call(nil)[0]
+	if rframes.Kind() != reflect.Slice {
+		return nil
+	}
+	switch rframes.Type().Elem().Kind() {
+	case reflect.Uintptr, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	default:
+		// Same method name and arity, but not actually a []errors.Frame
+		// (or similar uintptr-based type) in disguise.
+		return nil
+	}
+	pcs := make([]uintptr, rframes.Len())
+	for i := range pcs {
+		pcs[i] = uintptr(rframes.Index(i).Uint())
+	}
+	if len(pcs) == 0 {
+		return nil
+	}
+	return &Stacktrace{framesFromPCs(pcs, context, appPackagePrefixes)}
+}
+
+// framesFromPCs builds StacktraceFrames from program counters returned by
+// runtime.Callers (or, equivalently, a pkg/errors stack trace), expanding
+// inlined calls via runtime.CallersFrames.
+func framesFromPCs(pcs []uintptr, context int, appPackagePrefixes []string) []StacktraceFrame {
+	if appPackagePrefixes == nil && buildInfo != nil && buildInfo.Main.Path != "" {
+		appPackagePrefixes = []string{buildInfo.Main.Path}
+	}
+
 	var frames []StacktraceFrame
-	for i := 1 + skip; ; i++ {
-		pc, file, line, ok := runtime.Caller(i)
-		if !ok {
-			break
+	callersFrames := runtime.CallersFrames(pcs)
+	for {
+		callerFrame, more := callersFrames.Next()
+
+		frame := StacktraceFrame{
+			AbsolutePath: callerFrame.File,
+			Lineno:       callerFrame.Line,
+			InApp:        new(bool),
+		}
+		frame.Module, frame.Function = functionName(callerFrame.Function)
+		if filename, pkg := trimModulePath(callerFrame.File, frame.Module); pkg != "" {
+			frame.Filename = filename
+			frame.Package = pkg
+		} else {
+			frame.Filename = trimPath(callerFrame.File)
 		}
-		frame := StacktraceFrame{AbsolutePath: file, Filename: trimPath(file), Lineno: line, InApp: new(bool)}
-		frame.Module, frame.Function = functionName(pc)
 		if frame.Module == "main" {
 			*frame.InApp = true
 		} else {
@@ -69,7 +192,7 @@ func NewStacktrace(skip int, context int, appPackagePrefixes []string) *Stacktra
 		}
 
 		if context > 0 {
-			contextLines := fileContext(file, line-context, (context*2)+1)
+			contextLines := fileContext(callerFrame.File, frame.Filename, callerFrame.Line-context, (context*2)+1)
 			if len(contextLines) > 0 {
 				for i, line := range contextLines {
 					switch {
@@ -83,51 +206,299 @@ func NewStacktrace(skip int, context int, appPackagePrefixes []string) *Stacktra
 				}
 			}
 		} else if context == -1 {
-			contextLine := fileContext(file, line, 1)
+			contextLine := fileContext(callerFrame.File, frame.Filename, callerFrame.Line, 1)
 			if len(contextLine) > 0 {
 				frame.ContextLine = string(contextLine[0])
 			}
 		}
 
 		frames = append(frames, frame)
+
+		if !more {
+			break
+		}
 	}
-	return &Stacktrace{frames}
+	return frames
 }
 
-// Retrieve the name of the package and function containing the PC.
-func functionName(pc uintptr) (pack string, name string) {
-	fn := runtime.FuncForPC(pc)
-	if fn == nil {
-		return
-	}
-	name = fn.Name()
+// Retrieve the name of the package and function from the fully qualified
+// name reported by runtime.Frame.Function, e.g. "runtime/debug.*T.ptrmethod".
+func functionName(name string) (pack string, fn string) {
+	fn = name
 	// We get this:
-	//	runtime/debug.*T·ptrmethod
+	//	runtime/debug.*T.ptrmethod
 	// and want this:
 	//  pack = runtime/debug
-	//	name = *T.ptrmethod
-	if idx := strings.LastIndex(name, "."); idx != -1 {
-		pack = name[:idx]
-		name = name[idx+1:]
+	//	fn = *T.ptrmethod
+	if idx := strings.LastIndex(fn, "/"); idx != -1 {
+		pack = fn[:idx+1]
+		fn = fn[idx+1:]
+	}
+	if idx := strings.Index(fn, "."); idx != -1 {
+		pack += fn[:idx]
+		fn = fn[idx+1:]
 	}
-	name = strings.Replace(name, "·", ".", -1)
 	return
 }
 
-var fileCacheLock sync.Mutex
-var fileCache = make(map[string][][]byte)
+// numCacheShards controls how many independent locks guard the source
+// cache; sharding by file path keeps concurrent stack captures for
+// different files from serializing on a single mutex.
+const numCacheShards = 16
 
-func fileContext(filename string, line int, count int) [][]byte {
-	fileCacheLock.Lock()
-	defer fileCacheLock.Unlock()
-	lines, ok := fileCache[filename]
-	if !ok {
-		data, err := ioutil.ReadFile(filename)
-		if err != nil {
-			return nil
+const (
+	defaultCacheMaxFiles = 128
+	defaultCacheMaxBytes = 4 << 20 // 4 MiB
+)
+
+type cacheEntry struct {
+	path  string
+	lines [][]byte
+	size  int64
+	mtime time.Time
+}
+
+type sourceCacheShard struct {
+	mu       sync.Mutex
+	entries  map[string]*list.Element // path -> element of lru, value *cacheEntry
+	lru      *list.List
+	bytes    int64
+	maxFiles int
+	maxBytes int64
+}
+
+var sourceCacheShards [numCacheShards]*sourceCacheShard
+
+func init() {
+	for i := range sourceCacheShards {
+		sourceCacheShards[i] = newSourceCacheShard(defaultCacheMaxFiles/numCacheShards, defaultCacheMaxBytes/numCacheShards)
+	}
+}
+
+func newSourceCacheShard(maxFiles int, maxBytes int64) *sourceCacheShard {
+	if maxFiles < 1 {
+		maxFiles = 1
+	}
+	return &sourceCacheShard{
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		maxFiles: maxFiles,
+		maxBytes: maxBytes,
+	}
+}
+
+// SetSourceCache configures the size of the in-memory cache of file
+// contents used to populate context_line/pre_context/post_context.
+// maxFiles and maxBytes bound the cache across all shards combined; each
+// shard gets an even share, rounded down but never less than one file (and
+// one byte when maxBytes is positive), so the combined bound is at least 16
+// files and 16 bytes. Calling SetSourceCache discards any previously
+// cached contents. The default is 128 files / 4 MiB.
+func SetSourceCache(maxFiles int, maxBytes int64) {
+	perShardFiles := maxFiles / numCacheShards
+	perShardBytes := maxBytes / numCacheShards
+	if maxBytes > 0 && perShardBytes == 0 {
+		perShardBytes = 1
+	}
+	for i := range sourceCacheShards {
+		sourceCacheShards[i] = newSourceCacheShard(perShardFiles, perShardBytes)
+	}
+}
+
+func cacheShardFor(path string) *sourceCacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return sourceCacheShards[h.Sum32()%numCacheShards]
+}
+
+// get returns the cached lines for path, rereading and re-caching the file
+// if it's missing, or if it has changed on disk since it was cached.
+// displayName is the module-trimmed form of path used to match registered
+// SourceProviders; it may differ from path, which is the on-disk (or
+// disk-equivalent) cache key used for stat-based invalidation.
+func (s *sourceCacheShard) get(path, displayName string) [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, statErr := os.Stat(path)
+
+	if elem, ok := s.entries[path]; ok {
+		entry := elem.Value.(*cacheEntry)
+		// A stat failure means path isn't a real file on disk (e.g. it was
+		// served by a SourceProvider); such content is assumed static, so
+		// keep serving the cached copy instead of invalidating on every call.
+		if statErr != nil || (info.Size() == entry.size && info.ModTime().Equal(entry.mtime)) {
+			s.lru.MoveToFront(elem)
+			return entry.lines
 		}
-		lines = bytes.Split(data, []byte{'\n'})
-		fileCache[filename] = lines
+		s.removeElement(elem)
+	}
+
+	lines, size, err := readSource(path, displayName)
+	if err != nil {
+		return nil
+	}
+	entry := &cacheEntry{path: path, lines: lines, size: size}
+	if statErr == nil {
+		entry.size = info.Size()
+		entry.mtime = info.ModTime()
+	}
+	s.entries[path] = s.lru.PushFront(entry)
+	s.bytes += entry.size
+	s.evict()
+	return entry.lines
+}
+
+func (s *sourceCacheShard) evict() {
+	for s.lru.Len() > s.maxFiles || (s.maxBytes > 0 && s.bytes > s.maxBytes) {
+		back := s.lru.Back()
+		if back == nil {
+			break
+		}
+		s.removeElement(back)
+	}
+}
+
+func (s *sourceCacheShard) removeElement(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	delete(s.entries, entry.path)
+	s.lru.Remove(elem)
+	s.bytes -= entry.size
+}
+
+// SourceProvider supplies the lines of a source file from somewhere other
+// than the local filesystem, for binaries that ship without their source
+// tree (stripped or containerized production builds). Get returns the file
+// split into lines, the same shape ioutil.ReadFile + bytes.Split would
+// produce for a file on disk.
+type SourceProvider interface {
+	Get(absPath string) ([][]byte, error)
+}
+
+type registeredProvider struct {
+	prefix   string
+	provider SourceProvider
+}
+
+var (
+	sourceProvidersMu sync.RWMutex
+	sourceProviders   []registeredProvider
+)
+
+func registerSourceProvider(prefix string, p SourceProvider) {
+	sourceProvidersMu.Lock()
+	defer sourceProvidersMu.Unlock()
+	sourceProviders = append(sourceProviders, registeredProvider{prefix: prefix, provider: p})
+}
+
+// readSource returns the lines of the source file at path (and their total
+// byte size), trying every SourceProvider whose prefix matches displayName
+// before falling back to reading path off disk.
+func readSource(path, displayName string) (lines [][]byte, size int64, err error) {
+	sourceProvidersMu.RLock()
+	providers := sourceProviders
+	sourceProvidersMu.RUnlock()
+
+	for _, rp := range providers {
+		if !strings.HasPrefix(displayName, rp.prefix) {
+			continue
+		}
+		if lines, err = rp.provider.Get(displayName); err == nil {
+			for _, l := range lines {
+				size += int64(len(l)) + 1
+			}
+			return lines, size, nil
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.Split(data, []byte{'\n'}), int64(len(data)), nil
+}
+
+// fsSourceProvider serves source lines out of an fs.FS, such as an
+// embed.FS holding the module's source tree bundled into the binary.
+type fsSourceProvider struct {
+	prefix string
+	fsys   fs.FS
+}
+
+func (p *fsSourceProvider) Get(absPath string) ([][]byte, error) {
+	rel := strings.TrimPrefix(strings.TrimPrefix(absPath, p.prefix), "/")
+	data, err := fs.ReadFile(p.fsys, rel)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Split(data, []byte{'\n'}), nil
+}
+
+// RegisterSourceFS registers fsys as a source of context lines for any
+// frame whose resolved path (after module-cache trimming; see
+// StacktraceFrame.Package) starts with prefix. This lets a binary built
+// with an embed.FS of its own source tree still produce context_line,
+// pre_context and post_context when it's deployed stripped or
+// containerized.
+func RegisterSourceFS(prefix string, fsys fs.FS) {
+	registerSourceProvider(prefix, &fsSourceProvider{prefix: prefix, fsys: fsys})
+}
+
+// zipSourceProvider serves source lines out of a zip archive of the source
+// tree shipped alongside the binary, keyed by the archive member name.
+type zipSourceProvider struct {
+	prefix string
+	index  map[string]*zip.File
+}
+
+func (p *zipSourceProvider) Get(absPath string) ([][]byte, error) {
+	rel := strings.TrimPrefix(strings.TrimPrefix(absPath, p.prefix), "/")
+	zf, ok := p.index[rel]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Split(data, []byte{'\n'}), nil
+}
+
+// RegisterSourceZip opens the zip archive at zipPath (e.g. a sources.zip
+// shipped next to a stripped production binary) and registers it as a
+// source of context lines for any frame whose resolved path starts with
+// prefix, the same way RegisterSourceFS does for an embed.FS.
+func RegisterSourceZip(prefix, zipPath string) error {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]*zip.File, len(zr.File))
+	for _, zf := range zr.File {
+		index[zf.Name] = zf
+	}
+	registerSourceProvider(prefix, &zipSourceProvider{prefix: prefix, index: index})
+	return nil
+}
+
+// fileContext returns count lines starting at line from absPath, consulting
+// any registered SourceProviders (matched against displayName, the
+// module-trimmed form of absPath) before falling back to reading absPath
+// directly off disk.
+func fileContext(absPath, displayName string, line int, count int) [][]byte {
+	path := absPath
+	if abs, err := filepath.Abs(absPath); err == nil {
+		path = abs
+	}
+
+	lines := cacheShardFor(path).get(path, displayName)
+	if lines == nil {
+		return nil
 	}
 	line-- // stack trace lines are 1-indexed
 	end := line + count
@@ -140,6 +511,83 @@ func fileContext(filename string, line int, count int) [][]byte {
 	return lines[line:end]
 }
 
+// buildInfo and modules describe the module graph of the running binary, as
+// reported by runtime/debug.ReadBuildInfo. Both are nil when the binary
+// wasn't built with module support (e.g. GOPATH-mode builds, or binaries
+// built without -trimpath metadata).
+var buildInfo *debug.BuildInfo
+var modules []*debug.Module
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	buildInfo = info
+	modules = append(modules, &info.Main)
+	for i := range info.Deps {
+		modules = append(modules, info.Deps[i])
+	}
+	// Longest Path first, so moduleFor's prefix match finds the most
+	// specific module for a given package path.
+	sort.Slice(modules, func(i, j int) bool { return len(modules[i].Path) > len(modules[j].Path) })
+}
+
+// moduleFor returns the module that owns the Go package at the given import
+// path, or nil if it can't be determined (e.g. no build info, or pkg is
+// part of the standard library).
+func moduleFor(pkg string) *debug.Module {
+	for _, m := range modules {
+		if pkg == m.Path || strings.HasPrefix(pkg, m.Path+"/") {
+			return m
+		}
+	}
+	return nil
+}
+
+// trimModulePath rewrites file, the on-disk path to a frame's source file,
+// into the module-relative form "<module>@<version>/relative/file.go" if
+// file lives under the module cache for a known dependency. It returns the
+// rewritten filename and the "<module>@<version>" string to populate
+// StacktraceFrame.Package; pkgVersion is empty if no rewrite was possible,
+// in which case the caller should fall back to trimPath.
+func trimModulePath(file, pkg string) (filename string, pkgVersion string) {
+	if buildInfo == nil || pkg == "" {
+		return "", ""
+	}
+	mod := moduleFor(pkg)
+	if mod == nil || mod.Path == buildInfo.Main.Path || mod.Replace != nil || mod.Version == "" {
+		// The main module and replaced modules don't live in the
+		// predictable $GOPATH/pkg/mod/<path>@<version>/ layout.
+		return "", ""
+	}
+	prefix := "/pkg/mod/" + escapeModulePath(mod.Path) + "@" + mod.Version + "/"
+	idx := strings.Index(file, prefix)
+	if idx == -1 {
+		return "", ""
+	}
+	pkgVersion = mod.Path + "@" + mod.Version
+	filename = pkgVersion + "/" + file[idx+len(prefix):]
+	return filename, pkgVersion
+}
+
+// escapeModulePath applies the module cache path escaping used by the go
+// command: every uppercase letter is replaced by an exclamation mark
+// followed by its lowercase form, so mixed-case import paths don't collide
+// on case-insensitive filesystems.
+func escapeModulePath(path string) string {
+	var buf bytes.Buffer
+	for _, r := range path {
+		if r >= 'A' && r <= 'Z' {
+			buf.WriteByte('!')
+			buf.WriteRune(r - 'A' + 'a')
+		} else {
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
 var trimPaths []string
 
 // Try to trim the GOROOT or GOPATH prefix off of a filename
@@ -0,0 +1,285 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package raven
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func writeTempFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile(%s): %v", path, err)
+	}
+	return path
+}
+
+func TestSourceCacheShardEvictsByFileCount(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{
+		writeTempFile(t, dir, "a.go", []byte("line1\nline2\n")),
+		writeTempFile(t, dir, "b.go", []byte("line1\nline2\n")),
+		writeTempFile(t, dir, "c.go", []byte("line1\nline2\n")),
+	}
+
+	shard := newSourceCacheShard(2, 1<<30)
+	for _, p := range paths {
+		shard.get(p, p)
+	}
+
+	if got := len(shard.entries); got != 2 {
+		t.Fatalf("len(entries) = %d, want 2", got)
+	}
+	if _, ok := shard.entries[paths[0]]; ok {
+		t.Errorf("least-recently-used entry %s was not evicted", paths[0])
+	}
+	if _, ok := shard.entries[paths[2]]; !ok {
+		t.Errorf("most-recently-used entry %s was evicted", paths[2])
+	}
+}
+
+func TestSourceCacheShardEvictsByByteBudget(t *testing.T) {
+	dir := t.TempDir()
+	big := writeTempFile(t, dir, "big.go", bytes.Repeat([]byte("a"), 100))
+	small := writeTempFile(t, dir, "small.go", []byte("a"))
+
+	shard := newSourceCacheShard(10, 50)
+	shard.get(big, big)
+	shard.get(small, small)
+
+	if _, ok := shard.entries[big]; ok {
+		t.Errorf("big file should have been evicted once the byte budget was exceeded")
+	}
+	if _, ok := shard.entries[small]; !ok {
+		t.Errorf("small file should still be cached")
+	}
+}
+
+func TestSourceCacheShardRereadsChangedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTempFile(t, dir, "f.go", []byte("old\n"))
+
+	shard := newSourceCacheShard(10, 1<<20)
+	lines := shard.get(path, path)
+	if len(lines) == 0 || string(lines[0]) != "old" {
+		t.Fatalf("get() = %q, want first line %q", lines, "old")
+	}
+
+	// Ensure the new mtime is observably different.
+	future := time.Now().Add(time.Second)
+	if err := ioutil.WriteFile(path, []byte("new\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	lines = shard.get(path, path)
+	if len(lines) == 0 || string(lines[0]) != "new" {
+		t.Fatalf("get() after rewrite = %q, want first line %q", lines, "new")
+	}
+}
+
+func TestEscapeModulePath(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"github.com/pkg/errors", "github.com/pkg/errors"},
+		{"github.com/BurntSushi/toml", "github.com/!burnt!sushi/toml"},
+		{"gopkg.in/Yaml.v2", "gopkg.in/!yaml.v2"},
+	}
+	for _, c := range cases {
+		if got := escapeModulePath(c.in); got != c.want {
+			t.Errorf("escapeModulePath(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func withTestModules(t *testing.T, info *debug.BuildInfo, mods []*debug.Module) {
+	t.Helper()
+	savedInfo, savedModules := buildInfo, modules
+	buildInfo, modules = info, mods
+	t.Cleanup(func() { buildInfo, modules = savedInfo, savedModules })
+}
+
+func TestTrimModulePath(t *testing.T) {
+	main := debug.Module{Path: "example.com/myapp"}
+	dep := &debug.Module{Path: "github.com/pkg/errors", Version: "v0.9.1"}
+	withTestModules(t, &debug.BuildInfo{Main: main}, []*debug.Module{&main, dep})
+
+	file := "/home/user/go/pkg/mod/github.com/pkg/errors@v0.9.1/errors.go"
+	filename, pkg := trimModulePath(file, "github.com/pkg/errors")
+	if want := "github.com/pkg/errors@v0.9.1"; pkg != want {
+		t.Errorf("pkg = %q, want %q", pkg, want)
+	}
+	if want := "github.com/pkg/errors@v0.9.1/errors.go"; filename != want {
+		t.Errorf("filename = %q, want %q", filename, want)
+	}
+
+	// A subpackage of a dependency module should resolve to the same module.
+	filename, pkg = trimModulePath(
+		"/home/user/go/pkg/mod/github.com/pkg/errors@v0.9.1/internal/bar.go",
+		"github.com/pkg/errors/internal",
+	)
+	if want := "github.com/pkg/errors@v0.9.1"; pkg != want {
+		t.Errorf("pkg = %q, want %q", pkg, want)
+	}
+	if want := "github.com/pkg/errors@v0.9.1/internal/bar.go"; filename != want {
+		t.Errorf("filename = %q, want %q", filename, want)
+	}
+
+	// Main module frames live outside the module cache and aren't rewritten.
+	filename, pkg = trimModulePath("/home/user/myapp/main.go", "example.com/myapp")
+	if filename != "" || pkg != "" {
+		t.Errorf("trimModulePath for main module frame = (%q, %q), want (\"\", \"\")", filename, pkg)
+	}
+
+	// Unknown packages (e.g. stdlib) aren't rewritten either.
+	filename, pkg = trimModulePath("/usr/local/go/src/fmt/print.go", "fmt")
+	if filename != "" || pkg != "" {
+		t.Errorf("trimModulePath for unmatched package = (%q, %q), want (\"\", \"\")", filename, pkg)
+	}
+}
+
+// TestNewStacktraceTopFrame guards against the capture path attributing the
+// top frame to itself (NewStacktrace/callers) instead of the real caller.
+func TestNewStacktraceTopFrame(t *testing.T) {
+	st := NewStacktrace(0, 0, nil)
+	if len(st.Frames) == 0 {
+		t.Fatal("NewStacktrace captured no frames")
+	}
+	if got := st.Frames[0].Function; got != "TestNewStacktraceTopFrame" {
+		t.Errorf("top frame function = %q, want %q", got, "TestNewStacktraceTopFrame")
+	}
+}
+
+// TestGetOrNewStacktraceTopFrame mirrors TestNewStacktraceTopFrame for the
+// fallback path taken when err carries no embedded stack trace.
+func TestGetOrNewStacktraceTopFrame(t *testing.T) {
+	st := GetOrNewStacktrace(errors.New("boom"), 0, 0, nil)
+	if len(st.Frames) == 0 {
+		t.Fatal("GetOrNewStacktrace captured no frames")
+	}
+	if got := st.Frames[0].Function; got != "TestGetOrNewStacktraceTopFrame" {
+		t.Errorf("top frame function = %q, want %q", got, "TestGetOrNewStacktraceTopFrame")
+	}
+}
+
+// pkgErrorsShapedErr mimics the shape of github.com/pkg/errors' wrapped
+// errors: a StackTrace() method returning a slice of uintptr-convertible
+// program counters.
+type pkgErrorsShapedErr struct {
+	msg string
+	pcs []uintptr
+}
+
+func (e *pkgErrorsShapedErr) Error() string         { return e.msg }
+func (e *pkgErrorsShapedErr) StackTrace() []uintptr { return e.pcs }
+
+func TestStacktraceFromErrorPkgErrorsShaped(t *testing.T) {
+	var pcs [16]uintptr
+	n := runtime.Callers(1, pcs[:]) // skip runtime.Callers itself; frame 0 is this test.
+	err := &pkgErrorsShapedErr{msg: "boom", pcs: pcs[:n]}
+
+	st := stacktraceFromError(err, 0, nil)
+	if st == nil {
+		t.Fatal("stacktraceFromError returned nil for a pkg/errors-shaped error")
+	}
+	if len(st.Frames) == 0 {
+		t.Fatal("stacktraceFromError captured no frames")
+	}
+	if got := st.Frames[0].Function; got != "TestStacktraceFromErrorPkgErrorsShaped" {
+		t.Errorf("top frame function = %q, want %q", got, "TestStacktraceFromErrorPkgErrorsShaped")
+	}
+}
+
+// weirdStackTracer has a same-named, same-arity StackTrace method that
+// doesn't return a uintptr-like slice; stacktraceFromError must not panic
+// on it.
+type weirdStackTracer struct{}
+
+func (weirdStackTracer) Error() string        { return "weird" }
+func (weirdStackTracer) StackTrace() []string { return []string{"not", "a", "stack"} }
+
+func TestStacktraceFromErrorRejectsNonUintptrSlice(t *testing.T) {
+	if st := stacktraceFromError(weirdStackTracer{}, 0, nil); st != nil {
+		t.Errorf("stacktraceFromError = %v, want nil for a non-uintptr StackTrace() slice", st)
+	}
+}
+
+func withCleanSourceProviders(t *testing.T) {
+	t.Helper()
+	saved := sourceProviders
+	sourceProviders = nil
+	t.Cleanup(func() { sourceProviders = saved })
+}
+
+func TestRegisterSourceFSRoundTrip(t *testing.T) {
+	withCleanSourceProviders(t)
+
+	fsys := fstest.MapFS{
+		"pkg/file.go": &fstest.MapFile{Data: []byte("line1\nline2\nline3\n")},
+	}
+	const prefix = "embed:mymodule@v1.0.0"
+	RegisterSourceFS(prefix, fsys)
+
+	lines, size, err := readSource("/does/not/exist/on/disk.go", prefix+"/pkg/file.go")
+	if err != nil {
+		t.Fatalf("readSource: %v", err)
+	}
+	if size == 0 {
+		t.Errorf("size = 0, want > 0")
+	}
+	if len(lines) == 0 || string(lines[0]) != "line1" {
+		t.Errorf("lines = %q, want first line %q", lines, "line1")
+	}
+}
+
+func TestRegisterSourceZipRoundTrip(t *testing.T) {
+	withCleanSourceProviders(t)
+
+	dir := t.TempDir()
+	zipPath := filepath.Join(dir, "src.zip")
+	f, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("pkg/file.go")
+	if err != nil {
+		t.Fatalf("zip Create: %v", err)
+	}
+	if _, err := w.Write([]byte("alpha\nbeta\n")); err != nil {
+		t.Fatalf("zip Write: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip Close: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	const prefix = "zip:mymodule@v1.0.0"
+	if err := RegisterSourceZip(prefix, zipPath); err != nil {
+		t.Fatalf("RegisterSourceZip: %v", err)
+	}
+
+	lines, _, err := readSource("/does/not/exist/on/disk.go", prefix+"/pkg/file.go")
+	if err != nil {
+		t.Fatalf("readSource: %v", err)
+	}
+	if len(lines) == 0 || string(lines[0]) != "alpha" {
+		t.Errorf("lines = %q, want first line %q", lines, "alpha")
+	}
+}